@@ -0,0 +1,188 @@
+package legacynet
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/lib/rules"
+)
+
+const hashedChainNameSegmentLength = 15
+
+var chainRoleAbbreviations = map[string]string{
+	prefixInput:              "in",
+	prefixNetOut:             "out",
+	prefixOverlay:            "ov",
+	suffixNetOutLog:          "log",
+	suffixNetOutRateLimitLog: "rl-log",
+}
+
+// HashedChainNamer is an alternative to the Postfix-based chain namer: it
+// derives chain names by SHA-256 hashing the seed (a container handle, or an
+// already-hashed chain name for Postfix) and base32-encoding a fixed-length
+// slice of the digest, following the same approach kube-router uses for its
+// per-pod iptables chains. Unlike the postfix scheme, which can silently
+// truncate and collide when handles are long, this always produces a
+// deterministic, fixed-length, collision-resistant name.
+type HashedChainNamer struct{}
+
+// Prefix implements chainNamer. role is one of prefixInput/prefixNetOut/
+// prefixOverlay; handle is the container handle.
+func (n *HashedChainNamer) Prefix(role, handle string) string {
+	return n.chainName(role, handle)
+}
+
+// Postfix implements chainNamer. chain is the chain name returned by an
+// earlier Prefix/Postfix call, and role is one of
+// suffixNetOutLog/suffixNetOutRateLimitLog.
+func (n *HashedChainNamer) Postfix(chain, role string) (string, error) {
+	return n.chainName(role, chain+":"+role), nil
+}
+
+func (n *HashedChainNamer) chainName(role, seed string) string {
+	abbreviation, ok := chainRoleAbbreviations[role]
+	if !ok {
+		abbreviation = role
+	}
+
+	sum := sha256.Sum256([]byte(seed))
+	encoded := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:]))
+	if len(encoded) > hashedChainNameSegmentLength {
+		encoded = encoded[:hashedChainNameSegmentLength]
+	}
+
+	return fmt.Sprintf("silk-%s-%s", abbreviation, encoded)
+}
+
+// legacyChainCleaner is the minimal surface MigrateLegacyChains needs from
+// the IPTables adapter to clean up chains orphaned by a namer change: undo
+// the external jump that makes a legacy chain live, empty it out, and remove
+// it.
+type legacyChainCleaner interface {
+	Delete(table, chain string, rulespec rules.IPTablesRule) error
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+}
+
+// MigrateLegacyChains detects, for the given handle, the chain names the
+// legacy namer would have produced and removes them if they differ from the
+// names HashedChainNamer produces for the same handle. This lets a rolling
+// upgrade switch ChainNamer implementations without orphaning iptables state
+// left behind under the old names.
+//
+// prefixInput/prefixNetOut/prefixOverlay chains are reachable from a
+// surviving built-in chain (INPUT/FORWARD), so their external jump has to be
+// torn down and the chain flushed before DeleteChain will succeed against it;
+// a netout chain's log/rl-log children are only ever jumped to from that
+// same (already torn-down) chain, so they just need flushing and deleting.
+// connLimitEnabled gates the rl-log cleanup, since that chain only exists
+// when rate limiting was turned on for the container being migrated.
+//
+// This runs on every NetOut.Initialize that has a LegacyChainNamer set and a
+// *HashedChainNamer as its ChainNamer, including for
+// handles that never had legacy state to begin with (any container created
+// after the switch to HashedChainNamer) and for handles already migrated by
+// a prior Initialize, so removeLegacyJump/deleteLegacyChain tolerate
+// iptables reporting the jump/chain as already gone - that's the expected
+// steady state, not a failure. Any other error is still propagated, so a
+// caller that gets a nil error can trust the legacy chains are actually
+// gone; on a real error, the legacy and hashed chains may both exist for
+// this handle until the next Initialize is retried.
+func (n *HashedChainNamer) MigrateLegacyChains(iptables legacyChainCleaner, legacyNamer chainNamer, handle, containerIP string, hostInterfaceNames []string, connLimitEnabled bool) error {
+	for _, role := range []string{prefixInput, prefixNetOut, prefixOverlay} {
+		legacyName := legacyNamer.Prefix(role, handle)
+		hashedName := n.Prefix(role, handle)
+		if legacyName == hashedName {
+			continue
+		}
+
+		if err := removeLegacyJump(iptables, role, legacyName, containerIP, hostInterfaceNames); err != nil {
+			return fmt.Errorf("removing legacy jump for %s: %s", legacyName, err)
+		}
+
+		if err := deleteLegacyChain(iptables, legacyName); err != nil {
+			return fmt.Errorf("deleting legacy chain %s: %s", legacyName, err)
+		}
+
+		if role != prefixNetOut {
+			continue
+		}
+
+		logRoles := []string{suffixNetOutLog}
+		if connLimitEnabled {
+			logRoles = append(logRoles, suffixNetOutRateLimitLog)
+		}
+		for _, logRole := range logRoles {
+			legacyLogName, err := legacyNamer.Postfix(legacyName, logRole)
+			if err != nil {
+				return fmt.Errorf("computing legacy %s chain name: %s", logRole, err)
+			}
+			if err := deleteLegacyChain(iptables, legacyLogName); err != nil {
+				return fmt.Errorf("deleting legacy chain %s: %s", legacyLogName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeLegacyJump deletes the exact jump condition(s) Initialize would have
+// installed into the legacy chain's ParentChain for role, mirroring
+// defaultNetOutRules' construction of the same conditions.
+func removeLegacyJump(iptables legacyChainCleaner, role, legacyName, containerIP string, hostInterfaceNames []string) error {
+	var parent string
+	var jumpConditions []rules.IPTablesRule
+
+	switch role {
+	case prefixInput:
+		parent = "INPUT"
+		jumpConditions = []rules.IPTablesRule{{"-s", containerIP, "--jump", legacyName}}
+	case prefixNetOut:
+		parent = "FORWARD"
+		jumpConditions = rules.NewNetOutJumpConditions(hostInterfaceNames, containerIP, legacyName)
+	case prefixOverlay:
+		parent = "FORWARD"
+		jumpConditions = []rules.IPTablesRule{{"--jump", legacyName}}
+	}
+
+	for _, jump := range jumpConditions {
+		if err := iptables.Delete("filter", parent, jump); err != nil && !isMissingLegacyState(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteLegacyChain(iptables legacyChainCleaner, chain string) error {
+	if err := iptables.ClearChain("filter", chain); err != nil && !isMissingLegacyState(err) {
+		return err
+	}
+	if err := iptables.DeleteChain("filter", chain); err != nil && !isMissingLegacyState(err) {
+		return err
+	}
+	return nil
+}
+
+// missingLegacyStateSubstrings are iptables(8)'s own messages for "there was
+// nothing here to remove": a -D whose rulespec matches no rule in the chain,
+// and a -F/-X against a chain that doesn't exist. MigrateLegacyChains treats
+// both as success rather than failure, which is what makes it idempotent.
+var missingLegacyStateSubstrings = []string{
+	"Bad rule",
+	"No chain/target/match by that name",
+}
+
+func isMissingLegacyState(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, substr := range missingLegacyStateSubstrings {
+		if strings.Contains(err.Error(), substr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package legacynet
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/lib/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HashedChainNamer", func() {
+	var namer *HashedChainNamer
+
+	BeforeEach(func() {
+		namer = &HashedChainNamer{}
+	})
+
+	Describe("Prefix", func() {
+		It("is deterministic for the same role and handle", func() {
+			Expect(namer.Prefix(prefixNetOut, "some-handle")).To(Equal(namer.Prefix(prefixNetOut, "some-handle")))
+		})
+
+		It("differs when the handle differs", func() {
+			Expect(namer.Prefix(prefixNetOut, "handle-a")).NotTo(Equal(namer.Prefix(prefixNetOut, "handle-b")))
+		})
+
+		It("uses the role's abbreviation", func() {
+			Expect(namer.Prefix(prefixNetOut, "some-handle")).To(HavePrefix("silk-out-"))
+			Expect(namer.Prefix(prefixInput, "some-handle")).To(HavePrefix("silk-in-"))
+			Expect(namer.Prefix(prefixOverlay, "some-handle")).To(HavePrefix("silk-ov-"))
+		})
+	})
+
+	Describe("Postfix", func() {
+		It("is deterministic for the same chain and role", func() {
+			postfixed, err := namer.Postfix("silk-out-abc", suffixNetOutLog)
+			Expect(err).NotTo(HaveOccurred())
+
+			again, err := namer.Postfix("silk-out-abc", suffixNetOutLog)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(postfixed).To(Equal(again))
+		})
+
+		It("differs between log and rate-limit-log roles", func() {
+			logChain, err := namer.Postfix("silk-out-abc", suffixNetOutLog)
+			Expect(err).NotTo(HaveOccurred())
+
+			rlLogChain, err := namer.Postfix("silk-out-abc", suffixNetOutRateLimitLog)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logChain).NotTo(Equal(rlLogChain))
+		})
+	})
+})
+
+// fakeLegacyNamer produces chain names by simple concatenation, which is
+// guaranteed to differ from HashedChainNamer's output so tests can exercise
+// the "names differ" migration path.
+type fakeLegacyNamer struct{}
+
+func (fakeLegacyNamer) Prefix(role, handle string) string {
+	return "legacy-" + role + "-" + handle
+}
+
+func (fakeLegacyNamer) Postfix(chain, role string) (string, error) {
+	return chain + "-" + role, nil
+}
+
+type fakeLegacyChainCleaner struct {
+	deletedRules  []string
+	clearedChains []string
+	deletedChains []string
+
+	deleteErr      error
+	clearChainErr  error
+	deleteChainErr error
+}
+
+func (f *fakeLegacyChainCleaner) Delete(table, chain string, rulespec rules.IPTablesRule) error {
+	f.deletedRules = append(f.deletedRules, chain)
+	return f.deleteErr
+}
+
+func (f *fakeLegacyChainCleaner) ClearChain(table, chain string) error {
+	f.clearedChains = append(f.clearedChains, chain)
+	return f.clearChainErr
+}
+
+func (f *fakeLegacyChainCleaner) DeleteChain(table, chain string) error {
+	f.deletedChains = append(f.deletedChains, chain)
+	return f.deleteChainErr
+}
+
+var _ = Describe("HashedChainNamer.MigrateLegacyChains", func() {
+	var (
+		namer       *HashedChainNamer
+		legacyNamer fakeLegacyNamer
+		cleaner     *fakeLegacyChainCleaner
+	)
+
+	BeforeEach(func() {
+		namer = &HashedChainNamer{}
+		legacyNamer = fakeLegacyNamer{}
+		cleaner = &fakeLegacyChainCleaner{}
+	})
+
+	It("removes the jump, flushes, and deletes each legacy prefix chain, plus its log children", func() {
+		err := namer.MigrateLegacyChains(cleaner, legacyNamer, "some-handle", "10.255.0.1", []string{"eth0"}, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		legacyNetOutChain := legacyNamer.Prefix(prefixNetOut, "some-handle")
+		legacyLogChain, _ := legacyNamer.Postfix(legacyNetOutChain, suffixNetOutLog)
+		legacyRLLogChain, _ := legacyNamer.Postfix(legacyNetOutChain, suffixNetOutRateLimitLog)
+
+		Expect(cleaner.deletedRules).To(ContainElement("INPUT"))
+		Expect(cleaner.deletedRules).To(ContainElement("FORWARD"))
+		Expect(cleaner.clearedChains).To(ContainElement(legacyNetOutChain))
+		Expect(cleaner.deletedChains).To(ContainElement(legacyNetOutChain))
+		Expect(cleaner.deletedChains).To(ContainElement(legacyLogChain))
+		Expect(cleaner.deletedChains).To(ContainElement(legacyRLLogChain))
+	})
+
+	It("skips the rate-limit log chain when connection limiting is disabled", func() {
+		err := namer.MigrateLegacyChains(cleaner, legacyNamer, "some-handle", "10.255.0.1", []string{"eth0"}, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		legacyNetOutChain := legacyNamer.Prefix(prefixNetOut, "some-handle")
+		legacyRLLogChain, _ := legacyNamer.Postfix(legacyNetOutChain, suffixNetOutRateLimitLog)
+
+		Expect(cleaner.deletedChains).NotTo(ContainElement(legacyRLLogChain))
+	})
+
+	It("is a no-op for a role whose legacy and hashed names already match", func() {
+		matchingNamer := namer // HashedChainNamer vs itself always agrees
+
+		err := namer.MigrateLegacyChains(cleaner, matchingNamer, "some-handle", "10.255.0.1", []string{"eth0"}, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cleaner.deletedChains).To(BeEmpty())
+		Expect(cleaner.clearedChains).To(BeEmpty())
+	})
+
+	It("propagates an error removing the jump instead of swallowing it", func() {
+		cleaner.deleteErr = errors.New("jump still referenced")
+
+		err := namer.MigrateLegacyChains(cleaner, legacyNamer, "some-handle", "10.255.0.1", []string{"eth0"}, true)
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("jump still referenced"))
+		Expect(cleaner.deletedChains).To(BeEmpty())
+	})
+
+	It("propagates an error deleting the chain instead of swallowing it", func() {
+		cleaner.deleteChainErr = errors.New("chain not empty")
+
+		err := namer.MigrateLegacyChains(cleaner, legacyNamer, "some-handle", "10.255.0.1", []string{"eth0"}, true)
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("chain not empty"))
+	})
+
+	It("is idempotent when the legacy jump is already gone", func() {
+		cleaner.deleteErr = errors.New("iptables: Bad rule (does a matching rule exist in that chain?).")
+
+		err := namer.MigrateLegacyChains(cleaner, legacyNamer, "some-handle", "10.255.0.1", []string{"eth0"}, true)
+
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("is idempotent when the legacy chain is already gone", func() {
+		cleaner.clearChainErr = errors.New("iptables: No chain/target/match by that name.")
+		cleaner.deleteChainErr = errors.New("iptables: No chain/target/match by that name.")
+
+		err := namer.MigrateLegacyChains(cleaner, legacyNamer, "some-handle", "10.255.0.1", []string{"eth0"}, true)
+
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
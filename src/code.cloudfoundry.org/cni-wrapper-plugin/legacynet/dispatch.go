@@ -0,0 +1,126 @@
+package legacynet
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/lib/rules"
+)
+
+const dispatchChainName = "silk-dispatch"
+const localPodsSetName = "silk-local-pods"
+const localPodsSetType = "hash:ip"
+
+// dispatchIPTablesAdapter is the subset of rules.IPTablesAdapter Dispatch
+// needs to maintain membership of the shared dispatch chain.
+type dispatchIPTablesAdapter interface {
+	BulkInsert(table, chain string, pos int, rulespec ...rules.IPTablesRule) error
+	Delete(table, chain string, rulespec rules.IPTablesRule) error
+}
+
+// DispatchIPSetAdapter is the ipset surface Dispatch needs to keep the
+// silk-local-pods set's membership in sync with the containers that
+// currently have a per-container chain installed.
+type DispatchIPSetAdapter interface {
+	Exists(setName string) (bool, error)
+	CreateSet(setName, setType string) error
+	DestroySet(setName string) error
+	AddToSet(setName, ip string) error
+	RemoveFromSet(setName, ip string) error
+}
+
+// Dispatch maintains the shared silk-dispatch chain and silk-local-pods
+// ipset that together replace NewNetOutJumpConditions' legacy behavior of
+// installing one jump directly in FORWARD per container per host interface.
+// With dispatch enabled, FORWARD instead carries a single
+// "-m set --match-set silk-local-pods dst -j silk-dispatch" jump, so
+// non-container traffic short-circuits out of the whole subsystem in one
+// match, and FORWARD no longer carries a net-out jump per container per host
+// interface. Each container's overlay chain is still jumped to directly from
+// FORWARD, one jump per container.
+// silk-dispatch itself carries one "-d <containerIP> -j <chain>" line per
+// container, added/removed via AddContainer/RemoveContainer as containers
+// come and go.
+type Dispatch struct {
+	IPTables dispatchIPTablesAdapter
+	IPSets   DispatchIPSetAdapter
+}
+
+func (d *Dispatch) dispatchJumpChain() IpTablesFullChain {
+	return IpTablesFullChain{
+		"filter",
+		"FORWARD",
+		dispatchChainName,
+		[]rules.IPTablesRule{{
+			"-m", "set", "--match-set", localPodsSetName, "dst",
+			"--jump", dispatchChainName,
+		}},
+		nil,
+	}
+}
+
+// Initialize creates the silk-local-pods ipset (the match-set jump installed
+// below fails to load with "Set silk-local-pods doesn't exist" if the set
+// isn't there first) and installs the silk-dispatch chain and its single
+// FORWARD jump. It is idempotent and should be called once at startup,
+// independently of any individual container's Initialize.
+func (d *Dispatch) Initialize() error {
+	exists, err := d.IPSets.Exists(localPodsSetName)
+	if err != nil {
+		return fmt.Errorf("checking ipset %s: %s", localPodsSetName, err)
+	}
+	if !exists {
+		if err := d.IPSets.CreateSet(localPodsSetName, localPodsSetType); err != nil {
+			return fmt.Errorf("creating ipset %s: %s", localPodsSetName, err)
+		}
+	}
+
+	if err := initChains(d.IPTables, []IpTablesFullChain{d.dispatchJumpChain()}); err != nil {
+		return fmt.Errorf("initializing dispatch chain: %s", err)
+	}
+
+	return nil
+}
+
+// Cleanup removes the silk-dispatch chain, its FORWARD jump, and the
+// silk-local-pods ipset.
+func (d *Dispatch) Cleanup() error {
+	if err := cleanupChains([]IpTablesFullChain{d.dispatchJumpChain()}, d.IPTables); err != nil {
+		return fmt.Errorf("cleaning up dispatch chain: %s", err)
+	}
+
+	if err := d.IPSets.DestroySet(localPodsSetName); err != nil {
+		return fmt.Errorf("destroying ipset %s: %s", localPodsSetName, err)
+	}
+
+	return nil
+}
+
+// AddContainer registers containerIP/chain in the dispatch chain and marks
+// containerIP as local in the silk-local-pods ipset, so FORWARD traffic to
+// it starts being dispatched to chain.
+func (d *Dispatch) AddContainer(containerIP, chain string) error {
+	if err := d.IPSets.AddToSet(localPodsSetName, containerIP); err != nil {
+		return fmt.Errorf("adding %s to %s: %s", containerIP, localPodsSetName, err)
+	}
+
+	rule := rules.IPTablesRule{"-d", containerIP, "--jump", chain}
+	if err := d.IPTables.BulkInsert("filter", dispatchChainName, 1, rule); err != nil {
+		return fmt.Errorf("inserting dispatch rule for %s: %s", containerIP, err)
+	}
+
+	return nil
+}
+
+// RemoveContainer undoes AddContainer for a container that has gone away.
+func (d *Dispatch) RemoveContainer(containerIP, chain string) error {
+	if err := d.IPSets.RemoveFromSet(localPodsSetName, containerIP); err != nil {
+		return fmt.Errorf("removing %s from %s: %s", containerIP, localPodsSetName, err)
+	}
+
+	rule := rules.IPTablesRule{"-d", containerIP, "--jump", chain}
+	if err := d.IPTables.Delete("filter", dispatchChainName, rule); err != nil {
+		return fmt.Errorf("deleting dispatch rule for %s: %s", containerIP, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package legacynet
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/lib/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeDispatchIPTablesAdapter struct {
+	bulkInserted []rules.IPTablesRule
+	deleted      []rules.IPTablesRule
+
+	bulkInsertErr error
+	deleteErr     error
+}
+
+func (f *fakeDispatchIPTablesAdapter) BulkInsert(table, chain string, pos int, rulespec ...rules.IPTablesRule) error {
+	f.bulkInserted = append(f.bulkInserted, rulespec...)
+	return f.bulkInsertErr
+}
+
+func (f *fakeDispatchIPTablesAdapter) Delete(table, chain string, rulespec rules.IPTablesRule) error {
+	f.deleted = append(f.deleted, rulespec)
+	return f.deleteErr
+}
+
+type fakeDispatchIPSetAdapter struct {
+	existing  bool
+	existsErr error
+
+	created   []string
+	destroyed []string
+	added     []string
+	removed   []string
+
+	createErr error
+}
+
+func (f *fakeDispatchIPSetAdapter) Exists(setName string) (bool, error) {
+	return f.existing, f.existsErr
+}
+
+func (f *fakeDispatchIPSetAdapter) CreateSet(setName, setType string) error {
+	f.created = append(f.created, setName)
+	f.existing = true
+	return f.createErr
+}
+
+func (f *fakeDispatchIPSetAdapter) DestroySet(setName string) error {
+	f.destroyed = append(f.destroyed, setName)
+	return nil
+}
+
+func (f *fakeDispatchIPSetAdapter) AddToSet(setName, ip string) error {
+	f.added = append(f.added, ip)
+	return nil
+}
+
+func (f *fakeDispatchIPSetAdapter) RemoveFromSet(setName, ip string) error {
+	f.removed = append(f.removed, ip)
+	return nil
+}
+
+var _ = Describe("Dispatch", func() {
+	var (
+		iptables *fakeDispatchIPTablesAdapter
+		ipsets   *fakeDispatchIPSetAdapter
+		dispatch *Dispatch
+	)
+
+	BeforeEach(func() {
+		iptables = &fakeDispatchIPTablesAdapter{}
+		ipsets = &fakeDispatchIPSetAdapter{}
+		dispatch = &Dispatch{IPTables: iptables, IPSets: ipsets}
+	})
+
+	Describe("Initialize", func() {
+		It("creates the silk-local-pods ipset before installing the dispatch chain", func() {
+			Expect(dispatch.Initialize()).To(Succeed())
+
+			Expect(ipsets.created).To(ConsistOf(localPodsSetName))
+		})
+
+		It("doesn't recreate the ipset if it already exists", func() {
+			ipsets.existing = true
+
+			Expect(dispatch.Initialize()).To(Succeed())
+
+			Expect(ipsets.created).To(BeEmpty())
+		})
+
+		It("returns an error if creating the ipset fails", func() {
+			ipsets.createErr = errors.New("ipset create failed")
+
+			err := dispatch.Initialize()
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("ipset create failed"))
+		})
+	})
+
+	Describe("AddContainer", func() {
+		It("adds the container IP to silk-local-pods and inserts its dispatch rule", func() {
+			Expect(dispatch.AddContainer("10.255.0.1", "silk-out-abc")).To(Succeed())
+
+			Expect(ipsets.added).To(ConsistOf("10.255.0.1"))
+			Expect(iptables.bulkInserted).To(ContainElement(rules.IPTablesRule{"-d", "10.255.0.1", "--jump", "silk-out-abc"}))
+		})
+	})
+
+	Describe("RemoveContainer", func() {
+		It("removes the container IP from silk-local-pods and deletes its dispatch rule", func() {
+			Expect(dispatch.RemoveContainer("10.255.0.1", "silk-out-abc")).To(Succeed())
+
+			Expect(ipsets.removed).To(ConsistOf("10.255.0.1"))
+			Expect(iptables.deleted).To(ContainElement(rules.IPTablesRule{"-d", "10.255.0.1", "--jump", "silk-out-abc"}))
+		})
+	})
+
+	Describe("Cleanup", func() {
+		It("destroys the silk-local-pods ipset", func() {
+			Expect(dispatch.Cleanup()).To(Succeed())
+
+			Expect(ipsets.destroyed).To(ConsistOf(localPodsSetName))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package legacynet
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestLegacynet(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Legacynet Suite")
+}
@@ -34,6 +34,8 @@ type OutConn struct {
 type NetOut struct {
 	ChainNamer            chainNamer
 	IPTables              rules.IPTablesAdapter
+	RestoreAdapter        IPTablesRestoreAdapter
+	AtomicRestore         bool
 	Converter             netOutRuleConverter
 	ASGLogging            bool
 	C2CLogging            bool
@@ -50,9 +52,18 @@ type NetOut struct {
 	DNSServers            []string
 	ContainerWorkload     string
 	Conn                  OutConn
+	Dispatch              *Dispatch
+	DispatchEnabled       bool
+	LegacyChainNamer      chainNamer
 }
 
 func (m *NetOut) Initialize() error {
+	if m.LegacyChainNamer != nil {
+		if err := m.migrateLegacyChains(); err != nil {
+			return fmt.Errorf("migrating legacy chains: %s", err)
+		}
+	}
+
 	args, err := m.defaultNetOutRules()
 	if err != nil {
 		return err
@@ -73,12 +84,26 @@ func (m *NetOut) Initialize() error {
 		return fmt.Errorf("input rules: %s", err)
 	}
 
-	err = initChains(m.IPTables, args)
+	if m.AtomicRestore {
+		err = m.ApplyAtomic(args)
+	} else {
+		if err = initChains(m.IPTables, args); err != nil {
+			return err
+		}
+		err = applyRules(m.IPTables, args)
+	}
 	if err != nil {
 		return err
 	}
 
-	return applyRules(m.IPTables, args)
+	if m.DispatchEnabled {
+		forwardChainName := m.ChainNamer.Prefix(prefixNetOut, m.ContainerHandle)
+		if err := m.Dispatch.AddContainer(m.ContainerIP, forwardChainName); err != nil {
+			return fmt.Errorf("dispatch: %s", err)
+		}
+	}
+
+	return nil
 }
 
 func (m *NetOut) Cleanup() error {
@@ -88,7 +113,33 @@ func (m *NetOut) Cleanup() error {
 		return err
 	}
 
-	return cleanupChains(args, m.IPTables)
+	if err := cleanupChains(args, m.IPTables); err != nil {
+		return err
+	}
+
+	if m.DispatchEnabled {
+		forwardChainName := m.ChainNamer.Prefix(prefixNetOut, m.ContainerHandle)
+		if err := m.Dispatch.RemoveContainer(m.ContainerIP, forwardChainName); err != nil {
+			return fmt.Errorf("dispatch: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// migrateLegacyChains cleans up the chains LegacyChainNamer would have
+// produced for this container if they differ from the ones m.ChainNamer
+// produces for it, so a rolling upgrade that switches ChainNamer
+// implementations doesn't orphan iptables state under the old names.
+// It only has anything to do once m.ChainNamer has actually been switched to
+// *HashedChainNamer; until then it's a no-op.
+func (m *NetOut) migrateLegacyChains() error {
+	hashedNamer, ok := m.ChainNamer.(*HashedChainNamer)
+	if !ok {
+		return nil
+	}
+
+	return hashedNamer.MigrateLegacyChains(m.IPTables, m.LegacyChainNamer, m.ContainerHandle, m.ContainerIP, m.HostInterfaceNames, m.Conn.Limit)
 }
 
 func (m *NetOut) BulkInsertRules(netOutRules []garden.NetOutRule) error {
@@ -115,8 +166,39 @@ func (m *NetOut) BulkInsertRules(netOutRules []garden.NetOutRule) error {
 		{"-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
 	}...)
 
-	err = m.IPTables.BulkInsert("filter", chain, 1, ruleSpec...)
+	if m.AtomicRestore {
+		return m.applyBulkInsertAtomic(chain, ruleSpec)
+	}
+
+	if err := m.IPTables.BulkInsert("filter", chain, 1, ruleSpec...); err != nil {
+		return fmt.Errorf("bulk inserting net-out rules: %s", err)
+	}
+
+	return nil
+}
+
+// applyBulkInsertAtomic re-applies just the net-out forward chain with
+// ruleSpec spliced in ahead of its existing tail rules (the default-reject/
+// logging rules Initialize installed), through the same restore-and-rollback
+// path Initialize uses, so an ASG update can no longer leave the chain
+// half-rewritten. The input/overlay/log chains aren't named in the restore
+// document, so they're left untouched.
+func (m *NetOut) applyBulkInsertAtomic(chain string, ruleSpec []rules.IPTablesRule) error {
+	args, err := m.defaultNetOutRules()
 	if err != nil {
+		return err
+	}
+
+	var forwardChain IpTablesFullChain
+	for _, c := range args {
+		if c.ChainName == chain {
+			forwardChain = c
+			break
+		}
+	}
+	forwardChain.Rules = append(append([]rules.IPTablesRule{}, ruleSpec...), forwardChain.Rules...)
+
+	if err := m.ApplyAtomic([]IpTablesFullChain{forwardChain}); err != nil {
 		return fmt.Errorf("bulk inserting net-out rules: %s", err)
 	}
 
@@ -128,6 +210,16 @@ func (m *NetOut) defaultNetOutRules() ([]IpTablesFullChain, error) {
 	forwardChainName := m.ChainNamer.Prefix(prefixNetOut, m.ContainerHandle)
 	overlayChain := m.ChainNamer.Prefix(prefixOverlay, m.ContainerHandle)
 
+	// With dispatch enabled, silk-dispatch (maintained by Dispatch.Add/
+	// RemoveContainer) is what jumps FORWARD traffic into forwardChainName,
+	// so forwardChainName itself no longer needs a direct FORWARD jump.
+	// Operators who haven't rolled out dispatch yet keep the legacy
+	// per-container, per-host-interface FORWARD jump.
+	forwardJumpConditions := rules.NewNetOutJumpConditions(m.HostInterfaceNames, m.ContainerIP, forwardChainName)
+	if m.DispatchEnabled {
+		forwardJumpConditions = nil
+	}
+
 	args := []IpTablesFullChain{
 		{
 			"filter",
@@ -146,7 +238,7 @@ func (m *NetOut) defaultNetOutRules() ([]IpTablesFullChain, error) {
 			"filter",
 			"FORWARD",
 			forwardChainName,
-			rules.NewNetOutJumpConditions(m.HostInterfaceNames, m.ContainerIP, forwardChainName),
+			forwardJumpConditions,
 			[]rules.IPTablesRule{
 				rules.NewNetOutDefaultRejectRule(),
 			},
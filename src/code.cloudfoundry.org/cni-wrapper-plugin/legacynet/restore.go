@@ -0,0 +1,124 @@
+package legacynet
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/lib/rules"
+)
+
+//go:generate counterfeiter -o ../fakes/iptables_restore_adapter.go --fake-name IPTablesRestoreAdapter . IPTablesRestoreAdapter
+type IPTablesRestoreAdapter interface {
+	// Snapshot returns the current contents of the given table in
+	// iptables-restore format, so a failed Restore can be rolled back.
+	Snapshot(table string) ([]byte, error)
+	// Restore applies document to table in a single iptables-restore
+	// invocation. noFlush maps to iptables-restore's --noflush: chains
+	// named in document are flushed and refilled, everything else in the
+	// table is left untouched.
+	Restore(table string, document []byte, noFlush bool) error
+}
+
+// ApplyAtomic serializes every chain in args - its header, jump conditions,
+// and rules - into a single iptables-restore document and applies it in one
+// syscall, instead of the many individual IPTables.BulkInsert/chain-create
+// calls Initialize and BulkInsertRules otherwise issue. A partial failure
+// mid-way can no longer leave a container with a half-applied firewall: if
+// the restore exits non-zero, the pre-apply snapshot is replayed to roll
+// back to the prior state.
+func (m *NetOut) ApplyAtomic(args []IpTablesFullChain) error {
+	table := restoreTable(args)
+
+	snapshot, err := m.RestoreAdapter.Snapshot(table)
+	if err != nil {
+		return fmt.Errorf("snapshotting %s table: %s", table, err)
+	}
+
+	if err := m.RestoreAdapter.Restore(table, buildRestoreDocument(args, snapshot), true); err != nil {
+		if rollbackErr := m.RestoreAdapter.Restore(table, snapshot, true); rollbackErr != nil {
+			return fmt.Errorf("applying rules: %s (rollback also failed: %s)", err, rollbackErr)
+		}
+		return fmt.Errorf("applying rules: %s", err)
+	}
+
+	return nil
+}
+
+func restoreTable(args []IpTablesFullChain) string {
+	if len(args) == 0 {
+		return "filter"
+	}
+	return args[0].Table
+}
+
+// buildRestoreDocument preserves today's ordering invariants (related/
+// established first, default reject last, rate-limit log chain ordering)
+// by emitting chain headers up front and then, for each chain in args
+// order, its jump conditions followed by its rules in the order they
+// already appear in the slice.
+//
+// The chains named in args are flushed and refilled (the ":name - [0:0]"
+// header), but their ParentChain (INPUT/FORWARD) is a built-in chain that
+// isn't, so a jump condition into it has to be handled more carefully than
+// the chain's own rules: it's inserted at the top, the established position
+// the old BulkInsert-based Initialize used, via "-I parent 1" rather than
+// appended; and snapshot - the parent chain's pre-apply contents, as
+// returned by RestoreAdapter.Snapshot - is consulted so a jump already
+// installed by a previous Initialize is left alone instead of duplicated.
+func buildRestoreDocument(args []IpTablesFullChain, snapshot []byte) []byte {
+	existingRules := existingRuleLines(snapshot)
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "*%s\n", restoreTable(args))
+
+	for _, chain := range args {
+		fmt.Fprintf(&buf, ":%s - [0:0]\n", chain.ChainName)
+	}
+
+	for _, chain := range args {
+		if chain.ParentChain != "" {
+			for _, jump := range chain.JumpConditions {
+				line := fmt.Sprintf("-A %s %s", chain.ParentChain, restoreRuleSpec(jump))
+				if existingRules[line] {
+					continue
+				}
+				fmt.Fprintf(&buf, "-I %s 1 %s\n", chain.ParentChain, restoreRuleSpec(jump))
+			}
+		}
+		for _, rule := range chain.Rules {
+			fmt.Fprintf(&buf, "-A %s %s\n", chain.ChainName, restoreRuleSpec(rule))
+		}
+	}
+
+	buf.WriteString("COMMIT\n")
+
+	return buf.Bytes()
+}
+
+// existingRuleLines extracts the "-A <chain> <rulespec>" lines out of an
+// iptables-save/Snapshot document, so buildRestoreDocument can tell a
+// parent-chain jump that's already installed apart from one that still
+// needs to be added.
+func existingRuleLines(snapshot []byte) map[string]bool {
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(snapshot), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "-A ") {
+			lines[line] = true
+		}
+	}
+	return lines
+}
+
+func restoreRuleSpec(rule rules.IPTablesRule) string {
+	fields := make([]string, len(rule))
+	for i, field := range rule {
+		if strings.ContainsAny(field, " \t") {
+			field = fmt.Sprintf("%q", field)
+		}
+		fields[i] = field
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,119 @@
+package legacynet
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/lib/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("buildRestoreDocument", func() {
+	chain := func() IpTablesFullChain {
+		return IpTablesFullChain{
+			"filter",
+			"FORWARD",
+			"silk-out-abc123",
+			[]rules.IPTablesRule{{"-s", "10.255.0.1", "--jump", "silk-out-abc123"}},
+			[]rules.IPTablesRule{{"--jump", "REJECT"}},
+		}
+	}
+
+	It("declares a header, flush marker, and COMMIT for every named chain", func() {
+		doc := string(buildRestoreDocument([]IpTablesFullChain{chain()}, nil))
+
+		Expect(doc).To(ContainSubstring("*filter\n"))
+		Expect(doc).To(ContainSubstring(":silk-out-abc123 - [0:0]\n"))
+		Expect(doc).To(ContainSubstring("-A silk-out-abc123 --jump REJECT\n"))
+		Expect(doc).To(HaveSuffix("COMMIT\n"))
+	})
+
+	It("inserts the parent-chain jump at the top rather than appending it", func() {
+		doc := string(buildRestoreDocument([]IpTablesFullChain{chain()}, nil))
+
+		Expect(doc).To(ContainSubstring("-I FORWARD 1 -s 10.255.0.1 --jump silk-out-abc123\n"))
+		Expect(doc).NotTo(ContainSubstring("-A FORWARD"))
+	})
+
+	It("skips a parent-chain jump that the snapshot shows is already installed", func() {
+		snapshot := []byte("*filter\n:FORWARD ACCEPT [0:0]\n-A FORWARD -s 10.255.0.1 --jump silk-out-abc123\nCOMMIT\n")
+
+		doc := string(buildRestoreDocument([]IpTablesFullChain{chain()}, snapshot))
+
+		Expect(doc).NotTo(ContainSubstring("FORWARD 1"))
+		Expect(doc).NotTo(ContainSubstring("-A FORWARD"))
+	})
+
+	It("quotes rule fields containing whitespace", func() {
+		c := IpTablesFullChain{
+			"filter",
+			"",
+			"silk-log",
+			nil,
+			[]rules.IPTablesRule{{"-m", "comment", "--comment", "two words"}},
+		}
+
+		doc := string(buildRestoreDocument([]IpTablesFullChain{c}, nil))
+
+		Expect(doc).To(ContainSubstring(`--comment "two words"`))
+	})
+})
+
+type fakeRestoreAdapter struct {
+	snapshot    []byte
+	snapshotErr error
+
+	failFirstRestore bool
+	restoredDocs     [][]byte
+	restoredNoFlush  []bool
+}
+
+func (f *fakeRestoreAdapter) Snapshot(table string) ([]byte, error) {
+	return f.snapshot, f.snapshotErr
+}
+
+func (f *fakeRestoreAdapter) Restore(table string, document []byte, noFlush bool) error {
+	f.restoredDocs = append(f.restoredDocs, document)
+	f.restoredNoFlush = append(f.restoredNoFlush, noFlush)
+
+	if f.failFirstRestore && len(f.restoredDocs) == 1 {
+		return errors.New("boom")
+	}
+	return nil
+}
+
+var _ = Describe("NetOut.ApplyAtomic", func() {
+	var (
+		adapter *fakeRestoreAdapter
+		netOut  *NetOut
+	)
+
+	BeforeEach(func() {
+		adapter = &fakeRestoreAdapter{snapshot: []byte("*filter\nCOMMIT\n")}
+		netOut = &NetOut{RestoreAdapter: adapter}
+	})
+
+	It("snapshots before restoring and applies the built document with --noflush", func() {
+		args := []IpTablesFullChain{{
+			"filter", "", "silk-out-abc123", nil, []rules.IPTablesRule{{"--jump", "REJECT"}},
+		}}
+
+		Expect(netOut.ApplyAtomic(args)).To(Succeed())
+
+		Expect(adapter.restoredDocs).To(HaveLen(1))
+		Expect(adapter.restoredNoFlush).To(Equal([]bool{true}))
+		Expect(string(adapter.restoredDocs[0])).To(ContainSubstring("-A silk-out-abc123 --jump REJECT"))
+	})
+
+	It("rolls back to the pre-apply snapshot when the restore fails", func() {
+		adapter.failFirstRestore = true
+
+		err := netOut.ApplyAtomic([]IpTablesFullChain{{"filter", "", "silk-out-abc123", nil, nil}})
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("boom"))
+		Expect(adapter.restoredDocs).To(HaveLen(2))
+		Expect(adapter.restoredDocs[1]).To(Equal(adapter.snapshot))
+	})
+})
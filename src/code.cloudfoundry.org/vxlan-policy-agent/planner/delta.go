@@ -0,0 +1,459 @@
+// +build !windows
+
+package planner
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"code.cloudfoundry.org/policy_client"
+	"code.cloudfoundry.org/vxlan-policy-agent/enforcer"
+)
+
+// PolicyDelta describes an incremental change to the policy/container
+// universe, as observed by PolicyClient.WatchPolicies or a long-poll ETag
+// callback, as opposed to the full snapshot queryPolicyServer/readFile
+// return on every poll.
+type PolicyDelta struct {
+	AddedPolicies         []policy_client.Policy
+	RemovedPolicies       []policy_client.Policy
+	AddedEgressPolicies   []policy_client.EgressPolicy
+	RemovedEgressPolicies []policy_client.EgressPolicy
+	AddedContainers       []container
+	RemovedContainers     []container
+	IngressTag            string
+}
+
+// ApplyDelta mutates only the Source/Destination/Egress/Ingress entries
+// affected by delta in the planner's cached containerPolicySet (p.cachedPolicySet),
+// instead of recomputing the full set the way GetRulesAndChain does on every
+// poll, and returns the minimal enforcer.RulesDelta needed to bring iptables
+// in line.
+//
+// A policy and a container can each be on one side of a rule the other
+// wasn't involved in creating - a newly added policy can apply to
+// already-existing containers, and a newly added container can be covered
+// by already-existing policies - so the added/removed policies and
+// containers are each crossed against the full (post-delta, for additions;
+// pre-delta, for removals) universe kept in the planner's cache, not just
+// against each other.
+//
+// Callers must fall back to the full GetRulesAndChain/full-sync path
+// whenever the watch connection errors or the cache is otherwise known
+// stale, since ApplyDelta has no way to detect a missed delta on its own.
+func (p *VxlanPolicyPlanner) ApplyDelta(delta PolicyDelta) (enforcer.RulesDelta, error) {
+	preDeltaContainers := p.cachedContainers
+	preDeltaPolicies := p.cachedPolicies
+	preDeltaEgressPolicies := p.cachedEgressPolicies
+
+	postDeltaContainers := mergeContainers(preDeltaContainers, delta.AddedContainers, delta.RemovedContainers)
+	postDeltaPolicies := mergePolicies(preDeltaPolicies, delta.AddedPolicies, delta.RemovedPolicies)
+	postDeltaEgressPolicies := mergeEgressPolicies(preDeltaEgressPolicies, delta.AddedEgressPolicies, delta.RemovedEgressPolicies)
+
+	addedByPolicy, err := p.getContainerPolicies(delta.AddedPolicies, delta.AddedEgressPolicies, delta.IngressTag, postDeltaContainers)
+	if err != nil {
+		return enforcer.RulesDelta{}, err
+	}
+	addedByContainer, err := p.getContainerPolicies(postDeltaPolicies, postDeltaEgressPolicies, delta.IngressTag, delta.AddedContainers)
+	if err != nil {
+		return enforcer.RulesDelta{}, err
+	}
+	added := mergeContainerPolicySet(containerPolicySet{}, addedByPolicy, containerPolicySet{})
+	added = mergeContainerPolicySet(added, addedByContainer, containerPolicySet{})
+
+	removedByPolicy, err := p.getContainerPolicies(delta.RemovedPolicies, delta.RemovedEgressPolicies, delta.IngressTag, preDeltaContainers)
+	if err != nil {
+		return enforcer.RulesDelta{}, err
+	}
+	removedByContainer, err := p.getContainerPolicies(preDeltaPolicies, preDeltaEgressPolicies, delta.IngressTag, delta.RemovedContainers)
+	if err != nil {
+		return enforcer.RulesDelta{}, err
+	}
+	removed := mergeContainerPolicySet(containerPolicySet{}, removedByPolicy, containerPolicySet{})
+	removed = mergeContainerPolicySet(removed, removedByContainer, containerPolicySet{})
+
+	preDeltaDestinationNames := destinationBucketNames(p.cachedPolicySet.DestinationSets)
+	preDeltaEgressNames := egressBucketNames(p.cachedPolicySet.EgressSets)
+
+	p.cachedContainers = postDeltaContainers
+	p.cachedPolicies = postDeltaPolicies
+	p.cachedEgressPolicies = postDeltaEgressPolicies
+	p.cachedPolicySet = mergeContainerPolicySet(p.cachedPolicySet, added, removed)
+
+	if p.EnableIPSets {
+		if err := p.IPSetSyncer.Sync(planIPSets(p.cachedPolicySet)); err != nil {
+			return enforcer.RulesDelta{}, err
+		}
+	}
+
+	// Under EnableIPSets, added/removed still carry a full bucket for any
+	// bucket that merely gained/lost a member, not just ones that came into
+	// or dropped out of existence - planIPTableRules would otherwise -I a
+	// duplicate of an already-installed --match-set rule, or -D one that
+	// still covers the bucket's other members. Membership-only changes are
+	// carried entirely by the IPSetSyncer.Sync call above, so only buckets
+	// that are genuinely new or fully gone should reach planIPTableRules.
+	rulesToAdd, rulesToRemove := added, removed
+	if p.EnableIPSets {
+		postDeltaDestinationNames := destinationBucketNames(p.cachedPolicySet.DestinationSets)
+		postDeltaEgressNames := egressBucketNames(p.cachedPolicySet.EgressSets)
+
+		rulesToAdd.DestinationSets = destinationBucketsNotIn(added.DestinationSets, preDeltaDestinationNames)
+		rulesToAdd.EgressSets = egressBucketsNotIn(added.EgressSets, preDeltaEgressNames)
+		rulesToRemove.DestinationSets = destinationBucketsNotIn(removed.DestinationSets, postDeltaDestinationNames)
+		rulesToRemove.EgressSets = egressBucketsNotIn(removed.EgressSets, postDeltaEgressNames)
+	}
+
+	return enforcer.RulesDelta{
+		RulesToAdd:    p.planIPTableRules(rulesToAdd),
+		RulesToRemove: p.planIPTableRules(rulesToRemove),
+	}, nil
+}
+
+func destinationBucketNames(buckets destinationBucketSlice) map[string]bool {
+	names := make(map[string]bool, len(buckets))
+	for _, b := range buckets {
+		names[b.Name] = true
+	}
+	return names
+}
+
+func egressBucketNames(buckets egressBucketSlice) map[string]bool {
+	names := make(map[string]bool, len(buckets))
+	for _, b := range buckets {
+		names[b.Name] = true
+	}
+	return names
+}
+
+// destinationBucketsNotIn filters buckets down to the ones whose name isn't
+// in names - used to narrow an added slice to buckets that weren't there
+// before the delta (genuinely new) or a removed slice to buckets that aren't
+// there after it (genuinely gone).
+func destinationBucketsNotIn(buckets destinationBucketSlice, names map[string]bool) destinationBucketSlice {
+	var filtered destinationBucketSlice
+	for _, b := range buckets {
+		if !names[b.Name] {
+			filtered = append(filtered, b)
+		}
+	}
+	return filtered
+}
+
+func egressBucketsNotIn(buckets egressBucketSlice, names map[string]bool) egressBucketSlice {
+	var filtered egressBucketSlice
+	for _, b := range buckets {
+		if !names[b.Name] {
+			filtered = append(filtered, b)
+		}
+	}
+	return filtered
+}
+
+// WatchPolicies consumes PolicyClient.WatchPolicies' delta channel and
+// applies each delta incrementally, pushing the resulting enforcer.RulesDelta
+// onto rulesChan so a caller can issue the targeted -I/-D calls directly
+// instead of waiting for the next full poll tick. It returns (giving up on
+// incremental mode) as soon as the watch channel errors or closes, so the
+// caller's regular poll loop can fall back to the full-sync GetRulesAndChain
+// path.
+func (p *VxlanPolicyPlanner) WatchPolicies(guids []string, rulesChan chan<- enforcer.RulesDelta) error {
+	deltas, err := p.PolicyClient.WatchPolicies(guids)
+	if err != nil {
+		return fmt.Errorf("watching policies: %s", err)
+	}
+
+	for delta := range deltas {
+		rulesDelta, err := p.ApplyDelta(delta)
+		if err != nil {
+			return fmt.Errorf("applying policy delta: %s", err)
+		}
+		rulesChan <- rulesDelta
+	}
+
+	return nil
+}
+
+// mergeContainerPolicySet applies added/removed onto cached, keeping the
+// sort order GetRulesAndChain's full-sync path relies on for deterministic
+// enforcer diffing. DestinationSets/EgressSets are merged the same way, at
+// the bucket level, so EnableIPSets keeps working under incremental sync.
+func mergeContainerPolicySet(cached, added, removed containerPolicySet) containerPolicySet {
+	merged := containerPolicySet{
+		Source:          mergeSourceSlice(cached.Source, added.Source, removed.Source),
+		Destination:     mergeDestinationSlice(cached.Destination, added.Destination, removed.Destination),
+		Ingress:         mergeIngressSlice(cached.Ingress, added.Ingress, removed.Ingress),
+		Egress:          mergeEgressSlice(cached.Egress, added.Egress, removed.Egress),
+		DestinationSets: mergeDestinationBucketSlice(cached.DestinationSets, added.DestinationSets, removed.DestinationSets),
+		EgressSets:      mergeEgressBucketSlice(cached.EgressSets, added.EgressSets, removed.EgressSets),
+	}
+
+	sort.Sort(merged.Source)
+	sort.Sort(merged.Destination)
+	sort.Sort(merged.Egress)
+	sort.Sort(merged.Ingress)
+	sort.Sort(merged.DestinationSets)
+	sort.Sort(merged.EgressSets)
+
+	return merged
+}
+
+func jsonKey(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func mergeSourceSlice(cached, added, removed sourceSlice) sourceSlice {
+	removedKeys := make(map[string]bool, len(removed))
+	for _, r := range removed {
+		removedKeys[jsonKey(r)] = true
+	}
+
+	seen := make(map[string]bool)
+	var merged sourceSlice
+	for i, c := range append(append(sourceSlice{}, cached...), added...) {
+		key := jsonKey(c)
+		// A removal only drops a cached entry; an entry that is also in
+		// added is kept.
+		if seen[key] || (i < len(cached) && removedKeys[key]) {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, c)
+	}
+
+	return merged
+}
+
+func mergeDestinationSlice(cached, added, removed destinationSlice) destinationSlice {
+	removedKeys := make(map[string]bool, len(removed))
+	for _, r := range removed {
+		removedKeys[jsonKey(r)] = true
+	}
+
+	seen := make(map[string]bool)
+	var merged destinationSlice
+	for _, c := range append(append(destinationSlice{}, cached...), added...) {
+		key := jsonKey(c)
+		if removedKeys[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, c)
+	}
+
+	return merged
+}
+
+func mergeEgressSlice(cached, added, removed egressSlice) egressSlice {
+	removedKeys := make(map[string]bool, len(removed))
+	for _, r := range removed {
+		removedKeys[jsonKey(r)] = true
+	}
+
+	seen := make(map[string]bool)
+	var merged egressSlice
+	for _, c := range append(append(egressSlice{}, cached...), added...) {
+		key := jsonKey(c)
+		if removedKeys[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, c)
+	}
+
+	return merged
+}
+
+func mergeIngressSlice(cached, added, removed ingressSlice) ingressSlice {
+	removedKeys := make(map[string]bool, len(removed))
+	for _, r := range removed {
+		removedKeys[jsonKey(r)] = true
+	}
+
+	seen := make(map[string]bool)
+	var merged ingressSlice
+	for _, c := range append(append(ingressSlice{}, cached...), added...) {
+		key := jsonKey(c)
+		if removedKeys[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, c)
+	}
+
+	return merged
+}
+
+// mergeDestinationBucketSlice merges bucket IP membership rather than whole
+// buckets, since two deltas can each contribute/withdraw members of the
+// same (SourceTag, Protocol, StartPort, EndPort) bucket.
+func mergeDestinationBucketSlice(cached, added, removed destinationBucketSlice) destinationBucketSlice {
+	byName := make(map[string]*destinationBucket, len(cached))
+	var order []string
+	for _, b := range cached {
+		bucket := b
+		byName[b.Name] = &bucket
+		order = append(order, b.Name)
+	}
+
+	for _, b := range removed {
+		if existing, ok := byName[b.Name]; ok {
+			existing.IPs = removeIPs(existing.IPs, b.IPs)
+			if len(existing.IPs) == 0 {
+				delete(byName, b.Name)
+			}
+		}
+	}
+
+	for _, b := range added {
+		if existing, ok := byName[b.Name]; ok {
+			existing.IPs = unionIPs(existing.IPs, b.IPs)
+		} else {
+			bucket := b
+			byName[b.Name] = &bucket
+			order = append(order, b.Name)
+		}
+	}
+
+	var merged destinationBucketSlice
+	for _, name := range order {
+		if bucket, ok := byName[name]; ok {
+			merged = append(merged, *bucket)
+		}
+	}
+
+	return merged
+}
+
+func mergeEgressBucketSlice(cached, added, removed egressBucketSlice) egressBucketSlice {
+	byName := make(map[string]*egressBucket, len(cached))
+	var order []string
+	for _, b := range cached {
+		bucket := b
+		byName[b.Name] = &bucket
+		order = append(order, b.Name)
+	}
+
+	for _, b := range removed {
+		if existing, ok := byName[b.Name]; ok {
+			existing.IPs = removeIPs(existing.IPs, b.IPs)
+			if len(existing.IPs) == 0 {
+				delete(byName, b.Name)
+			}
+		}
+	}
+
+	for _, b := range added {
+		if existing, ok := byName[b.Name]; ok {
+			existing.IPs = unionIPs(existing.IPs, b.IPs)
+		} else {
+			bucket := b
+			byName[b.Name] = &bucket
+			order = append(order, b.Name)
+		}
+	}
+
+	var merged egressBucketSlice
+	for _, name := range order {
+		if bucket, ok := byName[name]; ok {
+			merged = append(merged, *bucket)
+		}
+	}
+
+	return merged
+}
+
+func unionIPs(a, b []string) []string {
+	seen := make(map[string]bool, len(a))
+	result := append([]string{}, a...)
+	for _, ip := range a {
+		seen[ip] = true
+	}
+	for _, ip := range b {
+		if !seen[ip] {
+			seen[ip] = true
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+func removeIPs(from, toRemove []string) []string {
+	remove := make(map[string]bool, len(toRemove))
+	for _, ip := range toRemove {
+		remove[ip] = true
+	}
+
+	var result []string
+	for _, ip := range from {
+		if !remove[ip] {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+func mergeContainers(cached, added, removed []container) []container {
+	removedKeys := make(map[string]bool, len(removed))
+	for _, r := range removed {
+		removedKeys[jsonKey(r)] = true
+	}
+
+	seen := make(map[string]bool)
+	var merged []container
+	for _, c := range append(append([]container{}, cached...), added...) {
+		key := jsonKey(c)
+		if removedKeys[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, c)
+	}
+
+	return merged
+}
+
+func mergePolicies(cached, added, removed []policy_client.Policy) []policy_client.Policy {
+	removedKeys := make(map[string]bool, len(removed))
+	for _, r := range removed {
+		removedKeys[jsonKey(r)] = true
+	}
+
+	seen := make(map[string]bool)
+	var merged []policy_client.Policy
+	for _, p := range append(append([]policy_client.Policy{}, cached...), added...) {
+		key := jsonKey(p)
+		if removedKeys[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, p)
+	}
+
+	return merged
+}
+
+func mergeEgressPolicies(cached, added, removed []policy_client.EgressPolicy) []policy_client.EgressPolicy {
+	removedKeys := make(map[string]bool, len(removed))
+	for _, r := range removed {
+		removedKeys[jsonKey(r)] = true
+	}
+
+	seen := make(map[string]bool)
+	var merged []policy_client.EgressPolicy
+	for _, p := range append(append([]policy_client.EgressPolicy{}, cached...), added...) {
+		key := jsonKey(p)
+		if removedKeys[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, p)
+	}
+
+	return merged
+}
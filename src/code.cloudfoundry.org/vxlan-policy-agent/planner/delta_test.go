@@ -0,0 +1,122 @@
+package planner
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("jsonKey", func() {
+	It("is identical for structurally identical values", func() {
+		Expect(jsonKey(source{IP: "10.0.0.1", Tag: "a"})).To(Equal(jsonKey(source{IP: "10.0.0.1", Tag: "a"})))
+	})
+
+	It("differs for structurally different values", func() {
+		Expect(jsonKey(source{IP: "10.0.0.1", Tag: "a"})).NotTo(Equal(jsonKey(source{IP: "10.0.0.2", Tag: "a"})))
+	})
+})
+
+var _ = Describe("mergeSourceSlice", func() {
+	a := source{IP: "10.0.0.1", Tag: "a", GUID: "g1"}
+	b := source{IP: "10.0.0.2", Tag: "b", GUID: "g2"}
+	c := source{IP: "10.0.0.3", Tag: "c", GUID: "g3"}
+
+	It("keeps cached entries that aren't removed and appends added entries", func() {
+		merged := mergeSourceSlice(sourceSlice{a, b}, sourceSlice{c}, nil)
+		Expect(merged).To(ConsistOf(a, b, c))
+	})
+
+	It("drops cached entries that are removed", func() {
+		merged := mergeSourceSlice(sourceSlice{a, b}, nil, sourceSlice{a})
+		Expect(merged).To(ConsistOf(b))
+	})
+
+	It("doesn't duplicate an entry that's already cached", func() {
+		merged := mergeSourceSlice(sourceSlice{a}, sourceSlice{a}, nil)
+		Expect(merged).To(ConsistOf(a))
+	})
+
+	It("lets an added entry win over a simultaneous removal of the same cached entry", func() {
+		merged := mergeSourceSlice(sourceSlice{a}, sourceSlice{a}, sourceSlice{a})
+		Expect(merged).To(ConsistOf(a))
+	})
+})
+
+var _ = Describe("mergeContainers", func() {
+	a := container{IP: "10.0.0.1", AppID: "app-a"}
+	b := container{IP: "10.0.0.2", AppID: "app-b"}
+
+	It("unions cached and added, minus removed", func() {
+		merged := mergeContainers([]container{a}, []container{b}, nil)
+		Expect(merged).To(ConsistOf(a, b))
+
+		merged = mergeContainers([]container{a, b}, nil, []container{a})
+		Expect(merged).To(ConsistOf(b))
+	})
+})
+
+var _ = Describe("unionIPs/removeIPs", func() {
+	It("unions without duplicating shared members", func() {
+		Expect(unionIPs([]string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.2", "10.0.0.3"})).To(
+			ConsistOf("10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	})
+
+	It("removes only the given members", func() {
+		Expect(removeIPs([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, []string{"10.0.0.2"})).To(
+			ConsistOf("10.0.0.1", "10.0.0.3"))
+	})
+})
+
+var _ = Describe("mergeDestinationBucketSlice", func() {
+	It("adds new members to an existing bucket", func() {
+		cached := destinationBucketSlice{{Name: "silk-dst-a", IPs: []string{"10.0.0.1"}}}
+		added := destinationBucketSlice{{Name: "silk-dst-a", IPs: []string{"10.0.0.2"}}}
+
+		merged := mergeDestinationBucketSlice(cached, added, nil)
+
+		Expect(merged).To(HaveLen(1))
+		Expect(merged[0].IPs).To(ConsistOf("10.0.0.1", "10.0.0.2"))
+	})
+
+	It("introduces a brand-new bucket untouched", func() {
+		added := destinationBucketSlice{{Name: "silk-dst-new", IPs: []string{"10.0.0.5"}}}
+
+		merged := mergeDestinationBucketSlice(nil, added, nil)
+
+		Expect(merged).To(ConsistOf(destinationBucket{Name: "silk-dst-new", IPs: []string{"10.0.0.5"}}))
+	})
+
+	It("drops the bucket entirely once its last member is removed", func() {
+		cached := destinationBucketSlice{{Name: "silk-dst-a", IPs: []string{"10.0.0.1"}}}
+
+		merged := mergeDestinationBucketSlice(cached, nil, destinationBucketSlice{{Name: "silk-dst-a", IPs: []string{"10.0.0.1"}}})
+
+		Expect(merged).To(BeEmpty())
+	})
+
+	It("leaves a bucket with remaining members after a partial removal", func() {
+		cached := destinationBucketSlice{{Name: "silk-dst-a", IPs: []string{"10.0.0.1", "10.0.0.2"}}}
+
+		merged := mergeDestinationBucketSlice(cached, nil, destinationBucketSlice{{Name: "silk-dst-a", IPs: []string{"10.0.0.1"}}})
+
+		Expect(merged).To(HaveLen(1))
+		Expect(merged[0].IPs).To(ConsistOf("10.0.0.2"))
+	})
+})
+
+var _ = Describe("destinationBucketsNotIn/egressBucketsNotIn", func() {
+	It("drops buckets whose name is in the given set", func() {
+		buckets := destinationBucketSlice{{Name: "silk-dst-a"}, {Name: "silk-dst-b"}}
+
+		filtered := destinationBucketsNotIn(buckets, map[string]bool{"silk-dst-a": true})
+
+		Expect(filtered).To(ConsistOf(destinationBucket{Name: "silk-dst-b"}))
+	})
+
+	It("keeps a bucket whose name isn't in the given set", func() {
+		buckets := egressBucketSlice{{Name: "silk-eg-a"}}
+
+		filtered := egressBucketsNotIn(buckets, map[string]bool{"silk-eg-other": true})
+
+		Expect(filtered).To(ConsistOf(egressBucket{Name: "silk-eg-a"}))
+	})
+})
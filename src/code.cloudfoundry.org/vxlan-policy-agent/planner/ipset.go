@@ -0,0 +1,76 @@
+// +build !windows
+
+package planner
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+)
+
+// ipsetNameMaxLength mirrors the kernel's IPSET_MAXNAMELEN (32 bytes,
+// including the trailing NUL), so names must fit in 31 characters.
+const ipsetNameMaxLength = 31
+
+// ipsetName derives a deterministic, collision-resistant ipset name from the
+// given bucket fields. It follows the convention kube-router uses for its
+// KUBE-SRC-/KUBE-DST- sets: hash the tuple with SHA-256 and base32-encode the
+// digest, so two buckets only ever share a name if their fields are
+// identical, regardless of how long the underlying values are.
+func ipsetName(prefix string, fields ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(fields, "|")))
+	encoded := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:]))
+
+	name := prefix + encoded
+	if len(name) > ipsetNameMaxLength {
+		name = name[:ipsetNameMaxLength]
+	}
+	return name
+}
+
+// destinationBucket groups every c2c destination that shares a
+// (SourceTag, Protocol, StartPort, EndPort) tuple under a single "hash:ip"
+// ipset, so planIPTableRules can emit one matching rule instead of one per
+// destination IP.
+type destinationBucket struct {
+	Name       string
+	Protocol   string
+	StartPort  int
+	EndPort    int
+	SourceTag  string
+	SourceGUID string
+	IPs        []string
+}
+
+type destinationBucketSlice []destinationBucket
+
+func (s destinationBucketSlice) Len() int      { return len(s) }
+func (s destinationBucketSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s destinationBucketSlice) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
+
+// egressBucket groups every egress entry that shares a
+// (Protocol, IpStart, IpEnd, PortStart, PortEnd, IcmpType, IcmpCode) tuple
+// under a single "hash:ip" ipset of the sources' container IPs; the shared
+// destination CIDR is matched directly with "-m iprange" rather than put in
+// the set.
+type egressBucket struct {
+	Name      string
+	Protocol  string
+	IpStart   string
+	IpEnd     string
+	PortStart int
+	PortEnd   int
+	IcmpType  int
+	IcmpCode  int
+	IPs       []string
+}
+
+type egressBucketSlice []egressBucket
+
+func (s egressBucketSlice) Len() int      { return len(s) }
+func (s egressBucketSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s egressBucketSlice) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
@@ -0,0 +1,138 @@
+// +build !windows
+
+package planner
+
+import (
+	"fmt"
+)
+
+const (
+	ipSetTypeHashIP  = "hash:ip"
+	ipSetTypeHashNet = "hash:net"
+	tempSetSuffix    = "-tmp"
+)
+
+// IPSet is the desired state of a single named ipset: the kernel set type
+// (hash:ip for both c2c destination buckets, which hold destination container
+// IPs, and egress buckets, which hold source container IPs) and the members
+// it should contain.
+type IPSet struct {
+	Name    string
+	Type    string
+	Members []string
+}
+
+// planIPSets converts the bucketed destination/egress sets in
+// containerPolicySet into the IPSets that planIPTableRules' rules for the
+// same containerPolicySet reference, so IPSetSyncer has something to sync
+// against.
+func planIPSets(containerPolicySet containerPolicySet) []IPSet {
+	var sets []IPSet
+	for _, bucket := range containerPolicySet.DestinationSets {
+		sets = append(sets, IPSet{Name: bucket.Name, Type: ipSetTypeHashIP, Members: bucket.IPs})
+	}
+	for _, bucket := range containerPolicySet.EgressSets {
+		sets = append(sets, IPSet{Name: bucket.Name, Type: ipSetTypeHashIP, Members: bucket.IPs})
+	}
+	return sets
+}
+
+//go:generate counterfeiter -o ../fakes/ip_set_adapter.go --fake-name IPSetAdapter . IPSetAdapter
+type IPSetAdapter interface {
+	Exists(name string) (bool, error)
+	Create(name, setType string) error
+	Swap(name, tempName string) error
+	Destroy(name string) error
+	AddToSet(name, member string) error
+	ListSetNames(prefix string) ([]string, error)
+}
+
+// IPSetSyncer keeps the kernel's ipsets in line with the named buckets
+// planIPTableRules' "-m set --match-set" rules reference. Each set's
+// membership is replaced atomically: a freshly populated temporary set is
+// swapped in for the live one, rather than draining and refilling the live
+// set member-by-member while traffic is matching against it. Sets that are
+// no longer desired (a bucket disappeared because its policies/containers
+// did) are destroyed.
+type IPSetSyncer struct {
+	IPSets IPSetAdapter
+}
+
+// Sync applies the given desired sets and destroys any silk-managed set
+// that's no longer desired.
+func (s *IPSetSyncer) Sync(desired []IPSet) error {
+	desiredNames := make(map[string]bool, len(desired))
+	for _, set := range desired {
+		desiredNames[set.Name] = true
+		if err := s.apply(set); err != nil {
+			return err
+		}
+	}
+
+	if err := s.destroyStale(desiredNames); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *IPSetSyncer) apply(set IPSet) error {
+	tempName := tempSetName(set.Name)
+
+	if err := s.IPSets.Create(tempName, set.Type); err != nil {
+		return fmt.Errorf("creating ipset %s: %s", tempName, err)
+	}
+
+	for _, member := range set.Members {
+		if err := s.IPSets.AddToSet(tempName, member); err != nil {
+			return fmt.Errorf("adding %s to ipset %s: %s", member, tempName, err)
+		}
+	}
+
+	exists, err := s.IPSets.Exists(set.Name)
+	if err != nil {
+		return fmt.Errorf("checking ipset %s: %s", set.Name, err)
+	}
+	if !exists {
+		if err := s.IPSets.Create(set.Name, set.Type); err != nil {
+			return fmt.Errorf("creating ipset %s: %s", set.Name, err)
+		}
+	}
+
+	if err := s.IPSets.Swap(set.Name, tempName); err != nil {
+		return fmt.Errorf("swapping ipset %s: %s", set.Name, err)
+	}
+
+	if err := s.IPSets.Destroy(tempName); err != nil {
+		return fmt.Errorf("destroying ipset %s: %s", tempName, err)
+	}
+
+	return nil
+}
+
+func (s *IPSetSyncer) destroyStale(desiredNames map[string]bool) error {
+	for _, prefix := range []string{"silk-dst-", "silk-eg-"} {
+		existing, err := s.IPSets.ListSetNames(prefix)
+		if err != nil {
+			return fmt.Errorf("listing ipsets: %s", err)
+		}
+
+		for _, name := range existing {
+			if desiredNames[name] {
+				continue
+			}
+			if err := s.IPSets.Destroy(name); err != nil {
+				return fmt.Errorf("destroying stale ipset %s: %s", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func tempSetName(name string) string {
+	if len(name)+len(tempSetSuffix) > ipsetNameMaxLength {
+		name = name[:ipsetNameMaxLength-len(tempSetSuffix)]
+	}
+	return name + tempSetSuffix
+}
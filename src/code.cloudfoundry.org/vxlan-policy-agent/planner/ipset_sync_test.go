@@ -0,0 +1,98 @@
+package planner
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeIPSetAdapter struct {
+	existing  map[string]bool
+	members   map[string][]string
+	destroyed []string
+	swapped   [][2]string
+}
+
+func newFakeIPSetAdapter() *fakeIPSetAdapter {
+	return &fakeIPSetAdapter{
+		existing: map[string]bool{},
+		members:  map[string][]string{},
+	}
+}
+
+func (f *fakeIPSetAdapter) Exists(name string) (bool, error) {
+	return f.existing[name], nil
+}
+
+func (f *fakeIPSetAdapter) Create(name, setType string) error {
+	f.existing[name] = true
+	return nil
+}
+
+func (f *fakeIPSetAdapter) Swap(name, tempName string) error {
+	f.members[name] = f.members[tempName]
+	f.swapped = append(f.swapped, [2]string{name, tempName})
+	return nil
+}
+
+func (f *fakeIPSetAdapter) Destroy(name string) error {
+	delete(f.existing, name)
+	delete(f.members, name)
+	f.destroyed = append(f.destroyed, name)
+	return nil
+}
+
+func (f *fakeIPSetAdapter) AddToSet(name, member string) error {
+	f.members[name] = append(f.members[name], member)
+	return nil
+}
+
+func (f *fakeIPSetAdapter) ListSetNames(prefix string) ([]string, error) {
+	var names []string
+	for name := range f.existing {
+		if len(name) >= len(prefix) && name[:len(prefix)] == prefix {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+var _ = Describe("IPSetSyncer", func() {
+	var (
+		adapter *fakeIPSetAdapter
+		syncer  *IPSetSyncer
+	)
+
+	BeforeEach(func() {
+		adapter = newFakeIPSetAdapter()
+		syncer = &IPSetSyncer{IPSets: adapter}
+	})
+
+	It("creates a new set with the desired members via a temp-set swap", func() {
+		err := syncer.Sync([]IPSet{
+			{Name: "silk-dst-a", Type: ipSetTypeHashIP, Members: []string{"10.0.0.1", "10.0.0.2"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(adapter.existing["silk-dst-a"]).To(BeTrue())
+		Expect(adapter.members["silk-dst-a"]).To(ConsistOf("10.0.0.1", "10.0.0.2"))
+		Expect(adapter.existing["silk-dst-a-tmp"]).To(BeFalse())
+	})
+
+	It("destroys sets that are no longer desired", func() {
+		adapter.existing["silk-dst-stale"] = true
+
+		err := syncer.Sync(nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(adapter.destroyed).To(ContainElement("silk-dst-stale"))
+	})
+
+	It("leaves desired sets alone when destroying stale ones", func() {
+		err := syncer.Sync([]IPSet{
+			{Name: "silk-eg-keep", Type: ipSetTypeHashNet, Members: []string{"10.0.0.0/24"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(adapter.destroyed).NotTo(ContainElement("silk-eg-keep"))
+	})
+})
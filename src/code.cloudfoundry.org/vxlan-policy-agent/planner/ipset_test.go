@@ -0,0 +1,54 @@
+package planner
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ipsetName", func() {
+	It("is deterministic for the same fields", func() {
+		Expect(ipsetName("silk-dst-", "tag", "tcp", "80", "80")).To(
+			Equal(ipsetName("silk-dst-", "tag", "tcp", "80", "80")))
+	})
+
+	It("differs when any field differs", func() {
+		Expect(ipsetName("silk-dst-", "tag", "tcp", "80", "80")).NotTo(
+			Equal(ipsetName("silk-dst-", "tag", "tcp", "81", "81")))
+	})
+
+	It("carries the given prefix", func() {
+		Expect(ipsetName("silk-eg-", "tcp")).To(HavePrefix("silk-eg-"))
+	})
+
+	It("never exceeds the kernel's ipset name length", func() {
+		name := ipsetName("silk-dst-", strings.Repeat("x", 200))
+		Expect(len(name)).To(BeNumerically("<=", ipsetNameMaxLength))
+	})
+})
+
+var _ = Describe("destinationBucketSlice", func() {
+	It("sorts by name", func() {
+		buckets := destinationBucketSlice{
+			{Name: "silk-dst-b"},
+			{Name: "silk-dst-a"},
+		}
+
+		sortedCopy := append(destinationBucketSlice{}, buckets...)
+		sortedCopy.Swap(0, 1)
+		Expect(sortedCopy.Less(0, 1)).To(BeTrue())
+	})
+})
+
+var _ = Describe("egressBucketSlice", func() {
+	It("sorts by name", func() {
+		buckets := egressBucketSlice{
+			{Name: "silk-eg-b"},
+			{Name: "silk-eg-a"},
+		}
+
+		Expect(buckets.Less(1, 0)).To(BeTrue())
+		Expect(buckets.Less(0, 1)).To(BeFalse())
+	})
+})
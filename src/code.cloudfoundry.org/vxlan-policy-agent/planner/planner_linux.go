@@ -24,6 +24,14 @@ type containerPolicySet struct {
 	Destination destinationSlice
 	Ingress     ingressSlice
 	Egress      egressSlice
+
+	// DestinationSets and EgressSets are only populated when
+	// p.EnableIPSets is set, and in that mode Destination/Egress are left
+	// empty: the same information is held here instead, bucketed into ipsets
+	// so planIPTableRules can emit one rule per bucket instead of one per
+	// destination.
+	DestinationSets destinationBucketSlice
+	EgressSets      egressBucketSlice
 }
 
 type source struct {
@@ -172,6 +180,13 @@ func (p *VxlanPolicyPlanner) GetRulesAndChain() (enforcer.RulesWithChain, error)
 		p.Logger.Error("policy-client-get-container-policies", err)
 		return enforcer.RulesWithChain{}, err
 	}
+	if p.EnableIPSets {
+		if err := p.IPSetSyncer.Sync(planIPSets(containerPolicySet)); err != nil {
+			p.Logger.Error("ipset-sync", err)
+			return enforcer.RulesWithChain{}, err
+		}
+	}
+
 	ruleset := p.planIPTableRules(containerPolicySet)
 
 	p.Logger.Debug("generated-rules", lager.Data{"rules": ruleset})
@@ -214,13 +229,15 @@ func (p *VxlanPolicyPlanner) queryPolicyServer(allContainers []container) ([]pol
 func (p *VxlanPolicyPlanner) getContainerPolicies(policies []policy_client.Policy, egressPolicies []policy_client.EgressPolicy, ingressTag string, allContainers []container) (containerPolicySet, error) {
 	visited := make(map[string]bool)
 	var containerPolicySet containerPolicySet
+	destinationBuckets := make(map[string]*destinationBucket)
+	egressBuckets := make(map[string]*egressBucket)
 	for _, container := range allContainers {
 		for _, policy := range policies {
-			if container.AppID == policy.Source.ID {
+			if policyEndpointMatches(container.AppID, container.Labels, policy.Source.ID, policy.Source.Selector) {
 				if _, ok := visited[container.IP]; !ok {
 					containerPolicy := source{
 						Tag:  policy.Source.Tag,
-						GUID: policy.Source.ID,
+						GUID: policyEndpointIdentifier(policy.Source.ID, policy.Source.Selector),
 						IP:   container.IP,
 					}
 					containerPolicySet.Source = append(containerPolicySet.Source, containerPolicy)
@@ -228,24 +245,32 @@ func (p *VxlanPolicyPlanner) getContainerPolicies(policies []policy_client.Polic
 				}
 			}
 
-			if container.AppID == policy.Destination.ID {
-				containerPolicy := destination{
-					IP:         container.IP,
-					StartPort:  policy.Destination.Ports.Start,
-					EndPort:    policy.Destination.Ports.End,
-					Protocol:   policy.Destination.Protocol,
-					SourceTag:  policy.Source.Tag,
-					GUID:       policy.Destination.ID,
-					SourceGUID: policy.Source.ID,
+			if policyEndpointMatches(container.AppID, container.Labels, policy.Destination.ID, policy.Destination.Selector) {
+				sourceGUID := policyEndpointIdentifier(policy.Source.ID, policy.Source.Selector)
+				destinationGUID := policyEndpointIdentifier(policy.Destination.ID, policy.Destination.Selector)
+
+				if p.EnableIPSets {
+					p.addToDestinationBucket(destinationBuckets, container.IP, policy.Destination.Ports.Start, policy.Destination.Ports.End, policy.Destination.Protocol, policy.Source.Tag, sourceGUID)
+				} else {
+					containerPolicy := destination{
+						IP:         container.IP,
+						StartPort:  policy.Destination.Ports.Start,
+						EndPort:    policy.Destination.Ports.End,
+						Protocol:   policy.Destination.Protocol,
+						SourceTag:  policy.Source.Tag,
+						GUID:       destinationGUID,
+						SourceGUID: sourceGUID,
+					}
+					containerPolicySet.Destination = append(containerPolicySet.Destination, containerPolicy)
 				}
-				containerPolicySet.Destination = append(containerPolicySet.Destination, containerPolicy)
 			}
 		}
 
 		for _, egressPolicy := range egressPolicies {
 			if (egressPolicy.Source.ID == container.AppID) ||
 				(egressPolicy.Source.ID == container.SpaceID && egressPolicy.Source.Type == "space") ||
-				egressPolicy.Source.Type == "default" {
+				egressPolicy.Source.Type == "default" ||
+				labelsMatch(container.Labels, egressPolicy.Source.Selector) {
 				if containerPurposeMatchesAppLifecycle(container.Purpose, egressPolicy.AppLifecycle) {
 					var startPort, endPort int
 
@@ -254,17 +279,21 @@ func (p *VxlanPolicyPlanner) getContainerPolicies(policies []policy_client.Polic
 						endPort = egressPolicy.Destination.Ports[0].End
 					}
 
-					containerPolicy := egress{
-						SourceIP:  container.IP,
-						Protocol:  egressPolicy.Destination.Protocol,
-						IpStart:   egressPolicy.Destination.IPRanges[0].Start,
-						IpEnd:     egressPolicy.Destination.IPRanges[0].End,
-						IcmpType:  egressPolicy.Destination.ICMPType,
-						IcmpCode:  egressPolicy.Destination.ICMPCode,
-						PortStart: startPort,
-						PortEnd:   endPort,
+					if p.EnableIPSets {
+						p.addToEgressBucket(egressBuckets, container.IP, egressPolicy.Destination.Protocol, egressPolicy.Destination.IPRanges[0].Start, egressPolicy.Destination.IPRanges[0].End, egressPolicy.Destination.ICMPType, egressPolicy.Destination.ICMPCode, startPort, endPort)
+					} else {
+						containerPolicy := egress{
+							SourceIP:  container.IP,
+							Protocol:  egressPolicy.Destination.Protocol,
+							IpStart:   egressPolicy.Destination.IPRanges[0].Start,
+							IpEnd:     egressPolicy.Destination.IPRanges[0].End,
+							IcmpType:  egressPolicy.Destination.ICMPType,
+							IcmpCode:  egressPolicy.Destination.ICMPCode,
+							PortStart: startPort,
+							PortEnd:   endPort,
+						}
+						containerPolicySet.Egress = append(containerPolicySet.Egress, containerPolicy)
 					}
-					containerPolicySet.Egress = append(containerPolicySet.Egress, containerPolicy)
 				}
 			}
 		}
@@ -287,14 +316,149 @@ func (p *VxlanPolicyPlanner) getContainerPolicies(policies []policy_client.Polic
 		}
 	}
 
+	if p.EnableIPSets {
+		for _, bucket := range destinationBuckets {
+			containerPolicySet.DestinationSets = append(containerPolicySet.DestinationSets, *bucket)
+		}
+		for _, bucket := range egressBuckets {
+			containerPolicySet.EgressSets = append(containerPolicySet.EgressSets, *bucket)
+		}
+	}
+
 	sort.Sort(containerPolicySet.Source)
 	sort.Sort(containerPolicySet.Destination)
 	sort.Sort(containerPolicySet.Egress)
 	sort.Sort(containerPolicySet.Ingress)
+	sort.Sort(containerPolicySet.DestinationSets)
+	sort.Sort(containerPolicySet.EgressSets)
 
 	return containerPolicySet, nil
 }
 
+// addToDestinationBucket buckets a c2c destination by the tuple
+// (SourceTag, Protocol, StartPort, EndPort) so planIPTableRules can later
+// emit a single ipset-matching rule for every IP sharing that tuple, instead
+// of one NewMarkAllowRule per destination.
+func (p *VxlanPolicyPlanner) addToDestinationBucket(buckets map[string]*destinationBucket, ip string, startPort, endPort int, protocol, sourceTag, sourceGUID string) {
+	fields := []string{sourceTag, protocol, strconv.Itoa(startPort), strconv.Itoa(endPort)}
+	name := ipsetName("silk-dst-", fields...)
+
+	bucket, ok := buckets[name]
+	if !ok {
+		bucket = &destinationBucket{
+			Name:       name,
+			Protocol:   protocol,
+			StartPort:  startPort,
+			EndPort:    endPort,
+			SourceTag:  sourceTag,
+			SourceGUID: sourceGUID,
+		}
+		buckets[name] = bucket
+	}
+	bucket.IPs = append(bucket.IPs, ip)
+}
+
+// addToEgressBucket buckets an egress entry by the tuple
+// (Protocol, IpStart, IpEnd, PortStart, PortEnd, IcmpType, IcmpCode) so
+// planIPTableRules can emit a single ipset-matching rule for every source IP
+// sharing that tuple, instead of one NewEgress rule per source.
+func (p *VxlanPolicyPlanner) addToEgressBucket(buckets map[string]*egressBucket, ip, protocol, ipStart, ipEnd string, icmpType, icmpCode, portStart, portEnd int) {
+	fields := []string{
+		protocol, ipStart, ipEnd,
+		strconv.Itoa(portStart), strconv.Itoa(portEnd),
+		strconv.Itoa(icmpType), strconv.Itoa(icmpCode),
+	}
+	name := ipsetName("silk-eg-", fields...)
+
+	bucket, ok := buckets[name]
+	if !ok {
+		bucket = &egressBucket{
+			Name:      name,
+			Protocol:  protocol,
+			IpStart:   ipStart,
+			IpEnd:     ipEnd,
+			PortStart: portStart,
+			PortEnd:   portEnd,
+			IcmpType:  icmpType,
+			IcmpCode:  icmpCode,
+		}
+		buckets[name] = bucket
+	}
+	bucket.IPs = append(bucket.IPs, ip)
+}
+
+// planDestinationSetRules emits one "-m set --match-set <name> dst" rule per
+// destination bucket in place of one NewMarkAllowRule per destination IP,
+// plus - mirroring NewMarkAllowLogRule's pairing of a logged rule ahead of
+// the accepting one - a logging twin when logging is enabled, since
+// EnableIPSets must not silently drop C2C accept logging. Each named ipset's
+// membership (bucket.IPs) is kept in sync with the rule that references it by
+// the IPSetSyncer.Sync call in GetRulesAndChain/ApplyDelta.
+func (p *VxlanPolicyPlanner) planDestinationSetRules(buckets destinationBucketSlice) []rules.IPTablesRule {
+	var ruleset []rules.IPTablesRule
+	for _, bucket := range buckets {
+		matchSet := rules.IPTablesRule{
+			"-m", "set", "--match-set", bucket.Name, "dst",
+		}
+		if bucket.Protocol != "" {
+			matchSet = append(matchSet, "-p", bucket.Protocol)
+		}
+		if bucket.StartPort != 0 || bucket.EndPort != 0 {
+			matchSet = append(matchSet, "--dport", portRange(bucket.StartPort, bucket.EndPort))
+		}
+		matchSet = append(matchSet, "-m", "mark", "--mark", bucket.SourceTag)
+
+		if p.LoggingState.IsEnabled() {
+			logRule := append(rules.IPTablesRule{}, matchSet...)
+			logRule = append(logRule,
+				"-m", "limit", "--limit", fmt.Sprintf("%d/s", p.IPTablesAcceptedUDPLogsPerSec),
+				"-j", "LOG", "--log-prefix", fmt.Sprintf("OK_%s ", bucket.SourceTag))
+			ruleset = append(ruleset, logRule)
+		}
+
+		rule := append(rules.IPTablesRule{}, matchSet...)
+		rule = append(rule, "-j", "ACCEPT")
+		ruleset = append(ruleset, rule)
+	}
+	return ruleset
+}
+
+// planEgressSetRules emits one "-m set --match-set <name> src" rule per
+// egress bucket, per host interface, in place of one NewEgress rule per
+// (egress policy x host interface x container). The bucket's ipset holds the
+// source container IPs that share its (Protocol, IpStart, IpEnd, PortStart,
+// PortEnd, IcmpType, IcmpCode) tuple, so the set is matched as "src" and the
+// destination CIDR - common to every member, so not worth a second ipset -
+// is matched directly with "-m iprange --dst-range", mirroring NewEgress.
+func (p *VxlanPolicyPlanner) planEgressSetRules(buckets egressBucketSlice) []rules.IPTablesRule {
+	var ruleset []rules.IPTablesRule
+	for _, bucket := range buckets {
+		for _, hostInterfaceName := range p.HostInterfaceNames {
+			rule := rules.IPTablesRule{
+				"-o", hostInterfaceName,
+				"-m", "set", "--match-set", bucket.Name, "src",
+				"-m", "iprange", "--dst-range", fmt.Sprintf("%s-%s", bucket.IpStart, bucket.IpEnd),
+			}
+			if bucket.Protocol != "" {
+				rule = append(rule, "-p", bucket.Protocol)
+			}
+			if bucket.Protocol == "icmp" {
+				rule = append(rule, "--icmp-type", fmt.Sprintf("%d/%d", bucket.IcmpType, bucket.IcmpCode))
+			}
+			if bucket.PortStart != 0 || bucket.PortEnd != 0 {
+				rule = append(rule, "--dport", portRange(bucket.PortStart, bucket.PortEnd))
+			}
+			rule = append(rule, "-j", "ACCEPT")
+			ruleset = append(ruleset, rule)
+		}
+	}
+	return ruleset
+}
+
+func portRange(start, end int) string {
+	return fmt.Sprintf("%d:%d", start, end)
+}
+
 func (p *VxlanPolicyPlanner) planIPTableRules(containerPolicySet containerPolicySet) []rules.IPTablesRule {
 	var ruleset []rules.IPTablesRule
 	for _, c2cSource := range containerPolicySet.Source {
@@ -304,41 +468,46 @@ func (p *VxlanPolicyPlanner) planIPTableRules(containerPolicySet containerPolicy
 			c2cSource.GUID))
 	}
 
-	for _, c2cDestination := range containerPolicySet.Destination {
-		if p.LoggingState.IsEnabled() {
-			ruleset = append(ruleset, rules.NewMarkAllowLogRule(
+	if p.EnableIPSets {
+		ruleset = append(ruleset, p.planDestinationSetRules(containerPolicySet.DestinationSets)...)
+		ruleset = append(ruleset, p.planEgressSetRules(containerPolicySet.EgressSets)...)
+	} else {
+		for _, c2cDestination := range containerPolicySet.Destination {
+			if p.LoggingState.IsEnabled() {
+				ruleset = append(ruleset, rules.NewMarkAllowLogRule(
+					c2cDestination.IP,
+					c2cDestination.Protocol,
+					c2cDestination.StartPort,
+					c2cDestination.EndPort,
+					c2cDestination.SourceTag,
+					c2cDestination.GUID,
+					p.IPTablesAcceptedUDPLogsPerSec,
+				))
+			}
+			ruleset = append(ruleset, rules.NewMarkAllowRule(
 				c2cDestination.IP,
 				c2cDestination.Protocol,
 				c2cDestination.StartPort,
 				c2cDestination.EndPort,
 				c2cDestination.SourceTag,
+				c2cDestination.SourceGUID,
 				c2cDestination.GUID,
-				p.IPTablesAcceptedUDPLogsPerSec,
 			))
 		}
-		ruleset = append(ruleset, rules.NewMarkAllowRule(
-			c2cDestination.IP,
-			c2cDestination.Protocol,
-			c2cDestination.StartPort,
-			c2cDestination.EndPort,
-			c2cDestination.SourceTag,
-			c2cDestination.SourceGUID,
-			c2cDestination.GUID,
-		))
-	}
 
-	for _, egressSource := range containerPolicySet.Egress {
-		for _, hostInterfaceName := range p.HostInterfaceNames {
-			ruleset = append(ruleset, rules.NewEgress(
-				hostInterfaceName,
-				egressSource.SourceIP,
-				egressSource.Protocol,
-				egressSource.IpStart,
-				egressSource.IpEnd,
-				egressSource.IcmpType,
-				egressSource.IcmpCode,
-				egressSource.PortStart,
-				egressSource.PortEnd))
+		for _, egressSource := range containerPolicySet.Egress {
+			for _, hostInterfaceName := range p.HostInterfaceNames {
+				ruleset = append(ruleset, rules.NewEgress(
+					hostInterfaceName,
+					egressSource.SourceIP,
+					egressSource.Protocol,
+					egressSource.IpStart,
+					egressSource.IpEnd,
+					egressSource.IcmpType,
+					egressSource.IcmpCode,
+					egressSource.PortStart,
+					egressSource.PortEnd))
+			}
 		}
 	}
 
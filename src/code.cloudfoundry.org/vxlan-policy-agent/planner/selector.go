@@ -0,0 +1,62 @@
+// +build !windows
+
+package planner
+
+import (
+	"sort"
+	"strings"
+)
+
+// policyEndpointMatches reports whether a container is covered by one side
+// (Source or Destination) of a policy. A non-empty endpointID is matched
+// exactly against the container's AppID, same as before selectors existed;
+// a policy with no ID relies entirely on selector, which is matched against
+// the labels the datastore recorded for the container. This lets a single
+// policy like "role=db ingress from role=web" cover every container with
+// that label instead of operators having to name each app GUID explicitly.
+func policyEndpointMatches(containerAppID string, containerLabels map[string]string, endpointID string, selector map[string]string) bool {
+	if endpointID != "" {
+		return containerAppID == endpointID
+	}
+
+	return labelsMatch(containerLabels, selector)
+}
+
+func labelsMatch(labels, selector map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// policyEndpointIdentifier returns a stable identifier for one side of a
+// policy, for use in rule GUIDs/comments and as a sort key. Exact-match
+// policies keep using their app GUID; selector policies have no single GUID,
+// so this falls back to a canonical (sorted-key) rendering of the selector
+// itself, which keeps sort.Sort over the selector-expanded slices
+// deterministic.
+func policyEndpointIdentifier(endpointID string, selector map[string]string) string {
+	if endpointID != "" {
+		return endpointID
+	}
+
+	keys := make([]string, 0, len(selector))
+	for key := range selector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + selector[key]
+	}
+
+	return "selector:" + strings.Join(pairs, ",")
+}
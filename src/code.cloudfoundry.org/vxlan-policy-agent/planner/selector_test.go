@@ -0,0 +1,54 @@
+package planner
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("policyEndpointMatches", func() {
+	It("matches on AppID exactly when the policy has one, ignoring labels", func() {
+		Expect(policyEndpointMatches("app-a", map[string]string{"role": "web"}, "app-a", nil)).To(BeTrue())
+		Expect(policyEndpointMatches("app-b", map[string]string{"role": "web"}, "app-a", nil)).To(BeFalse())
+	})
+
+	It("falls back to selector matching when the policy has no AppID", func() {
+		Expect(policyEndpointMatches("app-a", map[string]string{"role": "web"}, "", map[string]string{"role": "web"})).To(BeTrue())
+		Expect(policyEndpointMatches("app-a", map[string]string{"role": "api"}, "", map[string]string{"role": "web"})).To(BeFalse())
+	})
+})
+
+var _ = Describe("labelsMatch", func() {
+	It("is false for an empty/nil selector", func() {
+		Expect(labelsMatch(map[string]string{"role": "web"}, nil)).To(BeFalse())
+		Expect(labelsMatch(map[string]string{"role": "web"}, map[string]string{})).To(BeFalse())
+	})
+
+	It("requires every selector key to match", func() {
+		labels := map[string]string{"role": "web", "env": "prod"}
+
+		Expect(labelsMatch(labels, map[string]string{"role": "web"})).To(BeTrue())
+		Expect(labelsMatch(labels, map[string]string{"role": "web", "env": "prod"})).To(BeTrue())
+		Expect(labelsMatch(labels, map[string]string{"role": "web", "env": "staging"})).To(BeFalse())
+	})
+
+	It("is false when the container is missing a selector key entirely", func() {
+		Expect(labelsMatch(map[string]string{"role": "web"}, map[string]string{"env": "prod"})).To(BeFalse())
+	})
+})
+
+var _ = Describe("policyEndpointIdentifier", func() {
+	It("returns the AppID when one is set", func() {
+		Expect(policyEndpointIdentifier("app-a", map[string]string{"role": "web"})).To(Equal("app-a"))
+	})
+
+	It("renders a selector-only endpoint as a canonical sorted string", func() {
+		id := policyEndpointIdentifier("", map[string]string{"env": "prod", "role": "web"})
+		Expect(id).To(Equal("selector:env=prod,role=web"))
+	})
+
+	It("is deterministic regardless of map iteration order", func() {
+		first := policyEndpointIdentifier("", map[string]string{"env": "prod", "role": "web"})
+		second := policyEndpointIdentifier("", map[string]string{"role": "web", "env": "prod"})
+		Expect(first).To(Equal(second))
+	})
+})